@@ -5,11 +5,18 @@
 package objabi
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -29,7 +36,9 @@ func Flagprint(fd int) {
 	flag.PrintDefaults()
 }
 
-// This is a near exact copy of gcc's libiberty/argv.c buildargv
+// This is a near exact copy of gcc's libiberty/argv.c buildargv, extended to
+// additionally honor '#'-to-end-of-line comments and backslash-newline line
+// continuations, as found in the response files emitted by GCC/binutils.
 func buildargv(data []byte) []string {
 	var result []string
 
@@ -54,6 +63,16 @@ func buildargv(data []byte) []string {
 		return len(data)
 	}
 
+	// consume a '#' comment up to (but not including) the trailing newline
+	consume_comment := func(idx int, data []byte) int {
+		for i := idx; i < len(data); i++ {
+			if data[i] == '\n' {
+				return i
+			}
+		}
+		return len(data)
+	}
+
 	// consume initial whitespace
 	di = consume_whitespace(0, data)
 	if di >= len(data) {
@@ -62,15 +81,30 @@ func buildargv(data []byte) []string {
 
 	// argument loop
 	for di < len(data) {
+		// a '#' beginning a new argument starts a comment that runs to the
+		// end of the line and contributes no argument of its own
+		if data[di] == '#' {
+			di = consume_comment(di, data)
+			di = consume_whitespace(di, data)
+			continue
+		}
+
 		var arg string
 
 		// scan each individual argument
 		arg = ""
 		for di < len(data) {
-			if ISSPACE(data[di]) && !squote && !dquote && !bsquote {
+			if !squote && !dquote && !bsquote && ISSPACE(data[di]) {
 				break
 			}
 
+			// backslash-newline is a line continuation; drop both bytes
+			if bsquote && data[di] == '\n' {
+				bsquote = false
+				di += 1
+				continue
+			}
+
 			// backslash
 			if bsquote {
 				bsquote = false
@@ -118,51 +152,249 @@ func buildargv(data []byte) []string {
 	return result
 }
 
+// maxResponseFileDepth bounds how deeply response files may include other
+// response files, so that a cycle that somehow evades the visited-set check
+// (e.g. hard links, bind mounts) can't recurse forever.
+const maxResponseFileDepth = 64
+
+// ExpandResponseFiles walks args looking for '@file' response-file
+// references and replaces each one with the arguments it contains, applying
+// the substitution recursively so that a response file may itself reference
+// further response files (as GCC/binutils tools do). It returns an error
+// instead of calling log.Fatalf so that callers such as cmd/link, cmd/compile,
+// and cmd/asm can report failures in whatever way suits them and so that the
+// expansion logic itself can be unit-tested. Anything that is not a response
+// file (file not found, zero-length arg, etc) is passed through unchanged, on
+// the assumption that the user knows what they're doing, though a missing
+// '@file' is still reported through the active Diag sink so a typo doesn't
+// fail silently.
+func ExpandResponseFiles(args []string) ([]string, error) {
+	var expand func(args []string, visited map[string]bool, depth int) ([]string, error)
+	expand = func(args []string, visited map[string]bool, depth int) ([]string, error) {
+		var result []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "@") || len(arg) < 1 {
+				result = append(result, arg)
+				continue
+			}
+
+			name := arg[1:]
+			abs, err := filepath.Abs(name)
+			if err != nil {
+				abs = name
+			}
+
+			if visited[abs] {
+				return nil, fmt.Errorf("response file %s expands recursively", name)
+			}
+			if depth >= maxResponseFileDepth {
+				return nil, fmt.Errorf("response files nested too deeply (max %d) while expanding %s", maxResponseFileDepth, name)
+			}
+
+			file, err := os.Open(name)
+			if os.IsNotExist(err) {
+				diag.Warn("response file not found", "path", name)
+				result = append(result, arg)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to open response file (%s): %v", name, err)
+			}
+
+			contents, err := ioutil.ReadAll(file)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("unable to read contents of response file (%s): %v", name, err)
+			}
+			if err := file.Close(); err != nil {
+				return nil, fmt.Errorf("unable to close response file (%s): %v", name, err)
+			}
+
+			visited[abs] = true
+			expanded, err := expand(buildargv(contents), visited, depth+1)
+			delete(visited, abs)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, expanded...)
+		}
+		return result, nil
+	}
+
+	return expand(args, make(map[string]bool), 0)
+}
+
 func Flagparse(usage func()) {
 	flag.Usage = usage
 
-	// Expand any response files that were specified at the commandline. Anything
-	// that is not a response file (file not found, zero-length arg, etc) gets
-	// blindly added to the arg as we assume that the user knows what they're doing.
-
-	// FIXME: I think response files are recursive, so if that's true then this
-	// 		  code should be refactored to support recursive response files. Probably
-	//		  with a channel or something.
-	var args []string
-	for _, arg := range os.Args {
-		// Check that response file prefix doesn't exist or that arg is zero-length
-		if !strings.HasPrefix(arg, "@") || len(arg) < 1 {
-			args = append(args, arg)
-			continue
-		}
+	// Expand any response files that were specified at the commandline.
+	args, err := ExpandResponseFiles(os.Args)
+	if err != nil {
+		diag.Fatal("unable to expand response files", "error", err)
+		return
+	}
+
+	os.Args = args
+	flag.Parse()
+}
+
+// FlagLoadConfig reads a structured configuration file at path and applies
+// its key/value settings to any flag registered on fs — including flags
+// added via Flagcount and Flagfn1 — so that large flag sets (verbose debug
+// knobs, -d lists, -gcflags bundles) can be persisted to a file instead of
+// exceeding platform command-line length limits. It complements the @file
+// response-file support in ExpandResponseFiles. Call sites that want to
+// populate the package's flag.CommandLine, as the go tool subcommands do,
+// should pass flag.CommandLine for fs.
+//
+// The format is selected by the file's extension: ".json" is parsed as a
+// flat JSON object, and anything else is parsed as a minimal, flat subset of
+// TOML (one "key = value" assignment per line, "#" comments, quoted or bare
+// scalar values; no tables or arrays of tables). FlagLoadConfig should be
+// called before fs.Parse: command-line arguments processed afterward still
+// override whatever it sets, since Parse only touches the flags actually
+// named on the command line.
+//
+// Keys that don't name a registered flag are reported through the same
+// io.Writer used for usage output (fs.Output()), followed by the usage
+// message itself, and are also folded into the returned error; keys that do
+// name a flag are still applied.
+func FlagLoadConfig(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file (%s): %v", path, err)
+	}
+
+	var settings map[string]string
+	if strings.HasSuffix(path, ".json") {
+		settings, err = parseJSONConfig(data)
+	} else {
+		settings, err = parseTOMLConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse config file (%s): %v", path, err)
+	}
 
-		// Check to see if the @-prefixed file is non-existent
-		file, err := os.Open(arg[1:])
-		if os.IsNotExist(err) {
-			log.Printf("Unable to open response file (%s): %#v\n", arg[1:], err)
-			args = append(args, arg)
+	var unknown []string
+	for key, value := range settings {
+		f := fs.Lookup(key)
+		if f == nil {
+			unknown = append(unknown, key)
 			continue
 		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value %q for flag %s (from %s): %v", value, key, path, err)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		fmt.Fprintf(fs.Output(), "unknown flag(s) in config file %s: %s\n", path, strings.Join(unknown, ", "))
+		flagSetUsage(fs)
+		return fmt.Errorf("config file %s set %d unknown flag(s): %s", path, len(unknown), strings.Join(unknown, ", "))
+	}
 
-		// Okay, so now we have a file with args. So expand the file contents
-		contents, err := ioutil.ReadAll(file)
+	return nil
+}
+
+// flagSetUsage prints fs's usage message the same way the flag package's own
+// error handling does: fs.Usage if one was set, otherwise the default
+// "Usage of <name>:" header followed by the flag defaults.
+func flagSetUsage(fs *flag.FlagSet) {
+	if fs.Usage != nil {
+		fs.Usage()
+		return
+	}
+	fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+	fs.PrintDefaults()
+}
+
+// parseJSONConfig parses data as a flat JSON object into a set of flag
+// name/value pairs suitable for flag.Value.Set.
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := stringifyConfigValue(value)
 		if err != nil {
-			log.Fatalf("Unable to read contents of response file (%s): %#v", arg[1:], err)
+			return nil, fmt.Errorf("key %q: %v", key, err)
 		}
+		settings[key] = s
+	}
+	return settings, nil
+}
 
-		// Now we can add each arg from the file
-		for _, row := range buildargv(contents) {
-			args = append(args, row)
+// stringifyConfigValue converts a decoded JSON scalar (or array of scalars)
+// into the string form expected by flag.Value.Set. Arrays become
+// comma-separated strings, matching the convention already used by flags
+// like -d that accept a comma-separated list in a single argument.
+func stringifyConfigValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return strconv.FormatInt(int64(v), 10), nil
 		}
-
-		// We're done. Close it and move on
-		if err := file.Close(); err != nil {
-			log.Fatalf("Unable to close response file (%s): %#v", arg[1:], err)
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			s, err := stringifyConfigValue(elem)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
 		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
 	}
+}
 
-	os.Args = args
-	flag.Parse()
+// parseTOMLConfig parses data as a minimal, flat subset of TOML: one
+// "key = value" assignment per line, blank lines and "#" comments ignored,
+// values optionally double-quoted. Tables ("[section]") are not supported.
+func parseTOMLConfig(data []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", lineno)
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		quoted := strings.HasPrefix(value, `"`)
+		if !quoted {
+			if j := strings.Index(value, "#"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		if quoted && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+			value = value[1 : len(value)-1]
+		}
+
+		settings[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
 }
 
 func AddVersionFlag() {
@@ -198,11 +430,171 @@ func (versionFlag) Set(s string) error {
 	if s == "full" && strings.HasPrefix(Version, "devel") {
 		p += " buildID=" + buildID
 	}
+
+	if s == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(versionInfo(name)); err != nil {
+			log.Fatalf("-V=json: %v", err)
+		}
+		os.Exit(0)
+		return nil
+	}
+
 	fmt.Printf("%s version %s%s%s\n", name, Version, sep, p)
 	os.Exit(0)
 	return nil
 }
 
+// toolVersionInfo is the -V=json payload: a stable, parseable description of
+// this tool's identity, for build systems (bazel, distributed compile farms)
+// that would otherwise have to scrape the free-form -V/-V=full line.
+type toolVersionInfo struct {
+	Tool    string `json:"tool"`
+	Version string `json:"version"`
+	Exp     string `json:"experiments,omitempty"`
+	BuildID string `json:"buildID,omitempty"`
+	GOOS    string `json:"goos"`
+	GOARCH  string `json:"goarch"`
+	ToolID  string `json:"toolID"`
+}
+
+// versionInfo builds the -V=json payload for the tool named name. ToolID is
+// the same content the go command's build cache already hashes as this
+// tool's identity: the text that would follow "version " in -V=full output.
+func versionInfo(name string) toolVersionInfo {
+	exp := Expstring()
+	if exp == DefaultExpstring() {
+		exp = ""
+	}
+
+	toolID := Version
+	if exp != "" {
+		toolID += " " + exp
+	}
+	if strings.HasPrefix(Version, "devel") {
+		toolID += " buildID=" + buildID
+	}
+
+	return toolVersionInfo{
+		Tool:    name,
+		Version: Version,
+		Exp:     exp,
+		BuildID: buildID,
+		GOOS:    runtime.GOOS,
+		GOARCH:  runtime.GOARCH,
+		ToolID:  toolID,
+	}
+}
+
+// Diag is the sink for diagnostics raised by this package, and is meant to
+// also be used by the cmd/compile, cmd/link, and cmd/asm tools built on top
+// of it, so that warnings and errors can be rendered as plain text or as
+// structured JSON instead of being hard-wired to log.Printf/log.Fatalf. kv
+// is a flat list of alternating key, value pairs giving structured context
+// for the diagnostic; an odd trailing key is paired with a nil value.
+type Diag interface {
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	Fatal(msg string, kv ...interface{})
+}
+
+// diag is the active Diag sink, replaceable with SetDiag or the -diag flag
+// registered by AddDiagFlag. The default prints plain text to stderr.
+var diag Diag = textDiag{}
+
+// SetDiag installs d as the active diagnostics sink, replacing whatever was
+// installed before (the default, or a previous -diag flag). Tools built on
+// this package can use it to route diagnostics through their own reporting
+// machinery instead of (or in addition to) -diag.
+func SetDiag(d Diag) {
+	diag = d
+}
+
+// AddDiagFlag registers a -diag=text|json flag that selects the
+// diagnostics sink used by this package, the same way AddVersionFlag
+// registers -V.
+func AddDiagFlag() {
+	flag.Var(diagFlag{}, "diag", "diagnostics format: text or json")
+}
+
+type diagFlag struct{}
+
+func (diagFlag) String() string { return "" }
+func (diagFlag) Set(s string) error {
+	switch s {
+	case "text":
+		SetDiag(textDiag{})
+	case "json":
+		SetDiag(jsonDiag{})
+	default:
+		return fmt.Errorf("invalid -diag value %q: must be %q or %q", s, "text", "json")
+	}
+	return nil
+}
+
+func formatKV(kv []interface{}) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	if len(kv)%2 == 1 {
+		fmt.Fprintf(&b, " %v=<missing>", kv[len(kv)-1])
+	}
+	return b.String()
+}
+
+// textDiag is the default Diag: plain lines to stderr, matching the
+// log.Printf/log.Fatalf behavior this package used to hard-code.
+type textDiag struct{}
+
+func (textDiag) Warn(msg string, kv ...interface{}) {
+	fmt.Fprintf(os.Stderr, "warning: %s%s\n", msg, formatKV(kv))
+}
+
+func (textDiag) Error(msg string, kv ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s%s\n", msg, formatKV(kv))
+}
+
+func (textDiag) Fatal(msg string, kv ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s%s\n", msg, formatKV(kv))
+	os.Exit(1)
+}
+
+// jsonDiagEntry is the shape of each line jsonDiag writes.
+type jsonDiagEntry struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+func kvToContext(kv []interface{}) map[string]interface{} {
+	if len(kv) == 0 {
+		return nil
+	}
+	ctx := make(map[string]interface{}, (len(kv)+1)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		ctx[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	if len(kv)%2 == 1 {
+		ctx[fmt.Sprint(kv[len(kv)-1])] = nil
+	}
+	return ctx
+}
+
+// jsonDiag emits each diagnostic as a single JSON object line on stderr, for
+// build systems that want to parse diagnostics rather than scrape text.
+type jsonDiag struct{}
+
+func (jsonDiag) emit(level, msg string, kv []interface{}) {
+	json.NewEncoder(os.Stderr).Encode(jsonDiagEntry{Level: level, Message: msg, Context: kvToContext(kv)})
+}
+
+func (j jsonDiag) Warn(msg string, kv ...interface{})  { j.emit("warning", msg, kv) }
+func (j jsonDiag) Error(msg string, kv ...interface{}) { j.emit("error", msg, kv) }
+func (j jsonDiag) Fatal(msg string, kv ...interface{}) {
+	j.emit("fatal", msg, kv)
+	os.Exit(1)
+}
+
 // count is a flag.Value that is like a flag.Bool and a flag.Int.
 // If used as -name, it increments the count, but -name=x sets the count.
 // Used for verbose flag -v.
@@ -221,6 +613,12 @@ func (c *count) Set(s string) error {
 	default:
 		n, err := strconv.Atoi(s)
 		if err != nil {
+			// Don't also report this through the Diag sink: the error
+			// returned here is printed by flag.FlagSet.Set/Parse itself
+			// (plain text plus a usage dump) regardless of which Diag is
+			// installed, so routing it through diag as well would just
+			// duplicate that output on the text sink and defeat the point
+			// of -diag=json on this path.
 			return fmt.Errorf("invalid count %q", s)
 		}
 		*c = count(n)
@@ -0,0 +1,268 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objabi
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildargv(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"simple", "a b c", []string{"a", "b", "c"}},
+		{"quoted whitespace", `a "b c" 'd e'`, []string{"a", "b c", "d e"}},
+		{"escaped space", `a\ b c`, []string{"a b", "c"}},
+		{"comment", "a b # c d\ne", []string{"a", "b", "e"}},
+		{"comment at start of line", "a\n# whole line is a comment\nb", []string{"a", "b"}},
+		{"escaped newline", "a\\\nb c", []string{"ab", "c"}},
+		{"escape at buffer boundary", "a\\", []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildargv([]byte(tt.in))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildargv(%q) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objabi-flag-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("nested", func(t *testing.T) {
+		inner := write("inner.rsp", "-c -d")
+		outer := write("outer.rsp", "-a @"+inner+" -b")
+
+		got, err := ExpandResponseFiles([]string{"prog", "@" + outer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"prog", "-a", "-c", "-d", "-b"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ExpandResponseFiles = %#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("missing file is passed through and warned about", func(t *testing.T) {
+		saved := diag
+		defer SetDiag(saved)
+		sink := &fakeDiag{}
+		SetDiag(sink)
+
+		missing := filepath.Join(dir, "does-not-exist.rsp")
+		got, err := ExpandResponseFiles([]string{"@" + missing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"@" + missing}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ExpandResponseFiles = %#v, want %#v", got, want)
+		}
+		if !reflect.DeepEqual(sink.warns, []string{"response file not found"}) {
+			t.Errorf("warns = %v, want a single recorded diagnostic", sink.warns)
+		}
+	})
+
+	t.Run("cycle is detected", func(t *testing.T) {
+		a := filepath.Join(dir, "a.rsp")
+		b := filepath.Join(dir, "b.rsp")
+		if err := ioutil.WriteFile(a, []byte("@"+b), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(b, []byte("@"+a), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ExpandResponseFiles([]string{"@" + a}); err == nil {
+			t.Fatal("expected error for cyclic response files, got nil")
+		}
+	})
+}
+
+func TestFlagLoadConfig(t *testing.T) {
+	// Use a private FlagSet rather than flag.CommandLine: registering flags
+	// on the global set would panic ("flag redefined") on a repeat run of
+	// this test binary, e.g. under `go test -count=2`.
+	var str string
+	var cnt int
+	fs := flag.NewFlagSet("flagloadconfig-test", flag.ContinueOnError)
+	fs.StringVar(&str, "flagloadconfig-test-str", "", "test string flag")
+	fs.Var((*count)(&cnt), "flagloadconfig-test-count", "test count flag")
+	reset := func() { str, cnt = "", 0 }
+
+	dir, err := ioutil.TempDir("", "objabi-flag-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("json", func(t *testing.T) {
+		defer reset()
+		path := write("config.json", `{"flagloadconfig-test-str": "hello", "flagloadconfig-test-count": 3}`)
+		if err := FlagLoadConfig(fs, path); err != nil {
+			t.Fatal(err)
+		}
+		if str != "hello" || cnt != 3 {
+			t.Errorf("got str=%q cnt=%d, want str=%q cnt=%d", str, cnt, "hello", 3)
+		}
+	})
+
+	t.Run("toml", func(t *testing.T) {
+		defer reset()
+		path := write("config.toml", "# a comment\nflagloadconfig-test-str = \"world\"\nflagloadconfig-test-count = 5 # inline comment\n")
+		if err := FlagLoadConfig(fs, path); err != nil {
+			t.Fatal(err)
+		}
+		if str != "world" || cnt != 5 {
+			t.Errorf("got str=%q cnt=%d, want str=%q cnt=%d", str, cnt, "world", 5)
+		}
+	})
+
+	t.Run("unknown key is reported", func(t *testing.T) {
+		defer reset()
+		path := write("config-unknown.json", `{"flagloadconfig-test-does-not-exist": "x"}`)
+		if err := FlagLoadConfig(fs, path); err == nil {
+			t.Fatal("expected error for unknown key, got nil")
+		}
+	})
+}
+
+func TestVersionInfo(t *testing.T) {
+	info := versionInfo("asm")
+
+	if info.Tool != "asm" {
+		t.Errorf("Tool = %q, want %q", info.Tool, "asm")
+	}
+	if info.Version != Version {
+		t.Errorf("Version = %q, want %q", info.Version, Version)
+	}
+	if info.GOOS != runtime.GOOS || info.GOARCH != runtime.GOARCH {
+		t.Errorf("GOOS/GOARCH = %s/%s, want %s/%s", info.GOOS, info.GOARCH, runtime.GOOS, runtime.GOARCH)
+	}
+	if !strings.HasPrefix(info.ToolID, Version) {
+		t.Errorf("ToolID = %q, want it to start with Version %q", info.ToolID, Version)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var round toolVersionInfo
+	if err := json.Unmarshal(data, &round); err != nil {
+		t.Fatal(err)
+	}
+	if round != info {
+		t.Errorf("round-tripped %#v, want %#v", round, info)
+	}
+}
+
+// fakeDiag is a Diag that records diagnostics instead of printing them, so
+// tests can assert on what this package reports without scraping stderr.
+type fakeDiag struct {
+	warns, errors, fatals []string
+}
+
+func (f *fakeDiag) Warn(msg string, kv ...interface{})  { f.warns = append(f.warns, msg) }
+func (f *fakeDiag) Error(msg string, kv ...interface{}) { f.errors = append(f.errors, msg) }
+func (f *fakeDiag) Fatal(msg string, kv ...interface{}) { f.fatals = append(f.fatals, msg) }
+
+func TestDiag(t *testing.T) {
+	saved := diag
+	defer SetDiag(saved)
+
+	sink := &fakeDiag{}
+	SetDiag(sink)
+
+	diag.Warn("a warning", "key", "value")
+	diag.Error("an error")
+	diag.Fatal("a fatal error")
+
+	if !reflect.DeepEqual(sink.warns, []string{"a warning"}) {
+		t.Errorf("warns = %v", sink.warns)
+	}
+	if !reflect.DeepEqual(sink.errors, []string{"an error"}) {
+		t.Errorf("errors = %v", sink.errors)
+	}
+	if !reflect.DeepEqual(sink.fatals, []string{"a fatal error"}) {
+		t.Errorf("fatals = %v", sink.fatals)
+	}
+}
+
+// TestCountSetInvalid checks that an invalid count value is reported only
+// through the returned error, not also through the Diag sink: flag.FlagSet
+// already prints that error itself (plus a usage dump), so routing it
+// through Diag too would duplicate the diagnostic.
+func TestCountSetInvalid(t *testing.T) {
+	saved := diag
+	defer SetDiag(saved)
+
+	sink := &fakeDiag{}
+	SetDiag(sink)
+
+	var c count
+	if err := c.Set("not-a-number"); err == nil {
+		t.Fatal("expected an error from Set, got nil")
+	}
+	if len(sink.errors) != 0 {
+		t.Errorf("errors = %v, want none: count.Set must not duplicate the error through Diag", sink.errors)
+	}
+}
+
+func TestDiagFlag(t *testing.T) {
+	saved := diag
+	defer SetDiag(saved)
+
+	var f diagFlag
+	if err := f.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := diag.(jsonDiag); !ok {
+		t.Errorf("diag = %T, want jsonDiag", diag)
+	}
+
+	if err := f.Set("text"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := diag.(textDiag); !ok {
+		t.Errorf("diag = %T, want textDiag", diag)
+	}
+
+	if err := f.Set("bogus"); err == nil {
+		t.Fatal("expected an error for an unrecognized -diag value, got nil")
+	}
+}